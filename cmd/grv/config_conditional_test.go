@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// scanWordActivity scans input with the given scanner setup applied first, and returns the
+// activity (true for CtkWord, false for CtkSkipped) of each bare word token encountered, keyed by
+// the word's value in the order scanned
+func scanWordActivity(t *testing.T, input string, setup func(*ConfigScanner)) ([]string, map[string]bool) {
+	t.Helper()
+
+	var errs []string
+	scanner := &ConfigScanner{}
+	scanner.Init(strings.NewReader(input), "", collectErrors(&errs))
+
+	if setup != nil {
+		setup(scanner)
+	}
+
+	var order []string
+	active := make(map[string]bool)
+
+	for {
+		token, err := scanner.Scan()
+		if err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+
+		if token.tokenType == CtkEOF {
+			break
+		}
+
+		if token.tokenType == CtkWord || token.tokenType == CtkSkipped {
+			order = append(order, token.value)
+			active[token.value] = token.tokenType == CtkWord
+		}
+	}
+
+	if len(errs) != 0 {
+		t.Fatalf("expected no errors, got %v", errs)
+	}
+
+	return order, active
+}
+
+// TestScanReportsUnterminatedIfAtTopLevelEOF verifies that an if/elif/else block left unclosed by
+// an endif is reported through the ErrorHandler even when EOF is reached in the top-level file,
+// not just when it's reached while scanning an included file (see popInclude)
+func TestScanReportsUnterminatedIfAtTopLevelEOF(t *testing.T) {
+	types, errs := scanAll(t, "if has-theme dark\nwordA\n")
+
+	if len(errs) != 1 {
+		t.Fatalf("expected exactly one error, got %v: %v", len(errs), errs)
+	}
+
+	if types[len(types)-1] != CtkEOF {
+		t.Errorf("expected scanning to still reach CtkEOF, got %v", types)
+	}
+}
+
+// TestConditionalElifElseMatchedSuppression verifies that once an elif branch has matched, a
+// later else branch is suppressed even though no earlier branch in the chain was taken
+func TestConditionalElifElseMatchedSuppression(t *testing.T) {
+	input := "if env X == a\nwordIf\nelif env X == b\nwordElif\nelse\nwordElse\nendif\n"
+
+	_, active := scanWordActivity(t, input, func(scanner *ConfigScanner) {
+		scanner.SetVariable("X", "b")
+	})
+
+	cases := map[string]bool{
+		"wordIf":   false,
+		"wordElif": true,
+		"wordElse": false,
+	}
+
+	for word, want := range cases {
+		if got, ok := active[word]; !ok {
+			t.Errorf("expected %v to have been scanned", word)
+		} else if got != want {
+			t.Errorf("expected %v active=%v, got %v", word, want, got)
+		}
+	}
+}
+
+// TestConditionalNestedIfInsideInactiveBranchNeverTaken verifies that an if nested inside an
+// inactive branch is never taken, even when its own condition would otherwise hold
+func TestConditionalNestedIfInsideInactiveBranchNeverTaken(t *testing.T) {
+	input := "if env X == a\nif env Y == Y\ninner\nendif\nendif\n"
+
+	_, active := scanWordActivity(t, input, func(scanner *ConfigScanner) {
+		scanner.SetVariable("X", "b")
+		scanner.SetVariable("Y", "Y")
+	})
+
+	if got, ok := active["inner"]; !ok {
+		t.Errorf("expected inner to have been scanned")
+	} else if got {
+		t.Errorf("expected inner to be skipped since the outer if is inactive, got active")
+	}
+}
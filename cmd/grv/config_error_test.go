@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestPositionString verifies Position formats with and without a filename, matching the
+// go/token.Position-style "file:line:col" / "line:col" forms used in error messages
+func TestPositionString(t *testing.T) {
+	withFile := Position{Filename: "grvrc", Line: 3, Column: 5}
+	if got, want := withFile.String(), "grvrc:3:5"; got != want {
+		t.Errorf("Position.String() = %q, want %q", got, want)
+	}
+
+	withoutFile := Position{Line: 3, Column: 5}
+	if got, want := withoutFile.String(), "3:5"; got != want {
+		t.Errorf("Position.String() = %q, want %q", got, want)
+	}
+}
+
+// TestErrorHandlerReceivesPositionAndIncrementsErrorCount verifies that scanner.error reports
+// through the installed ErrorHandler with the position it was called at, and that ErrorCount
+// tracks the number of errors reported regardless of whether a handler is installed
+func TestErrorHandlerReceivesPositionAndIncrementsErrorCount(t *testing.T) {
+	var gotPositions []Position
+	var gotMessages []string
+
+	scanner := &ConfigScanner{}
+	scanner.Init(strings.NewReader(""), "grvrc", func(pos Position, msg string) {
+		gotPositions = append(gotPositions, pos)
+		gotMessages = append(gotMessages, msg)
+	})
+
+	pos := Position{Filename: "grvrc", Line: 2, Column: 1}
+	scanner.error(pos, "first error")
+	scanner.error(pos, "second error")
+
+	if scanner.ErrorCount != 2 {
+		t.Errorf("expected ErrorCount 2, got %v", scanner.ErrorCount)
+	}
+
+	if len(gotPositions) != 2 || gotPositions[0] != pos {
+		t.Errorf("expected the handler to receive the reported position, got %v", gotPositions)
+	}
+
+	if len(gotMessages) != 2 || gotMessages[0] != "first error" || gotMessages[1] != "second error" {
+		t.Errorf("expected the handler to receive the reported messages in order, got %v", gotMessages)
+	}
+}
+
+// TestErrorWithNilHandlerStillIncrementsErrorCount verifies a nil ErrorHandler (e.g. as installed
+// by NewConfigScanner) doesn't prevent ErrorCount from being tracked and doesn't panic
+func TestErrorWithNilHandlerStillIncrementsErrorCount(t *testing.T) {
+	scanner := NewConfigScanner(strings.NewReader(""))
+
+	scanner.error(scanner.pos, "an error")
+
+	if scanner.ErrorCount != 1 {
+		t.Errorf("expected ErrorCount 1, got %v", scanner.ErrorCount)
+	}
+}
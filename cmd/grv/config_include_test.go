@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// parseFile opens path, scans and parses it with a ConfigScanner/ConfigParser pair, and returns
+// the resulting scanner (so callers can inspect variables/ErrorCount) along with any messages
+// reported through the ErrorHandler
+func parseFile(t *testing.T, path string) (*ConfigScanner, []string) {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Unable to open %v: %v", path, err)
+	}
+	defer file.Close()
+
+	var errs []string
+	scanner := &ConfigScanner{}
+	scanner.Init(file, path, collectErrors(&errs))
+
+	if _, err := NewConfigParser(scanner).Parse(); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	return scanner, errs
+}
+
+// TestPushIncludeResolvesRelativeToIncludingFile verifies that a relative include path is
+// resolved against the directory of the file containing the include directive, not the
+// process's current working directory
+func TestPushIncludeResolvesRelativeToIncludingFile(t *testing.T) {
+	dir := t.TempDir()
+
+	rootPath := filepath.Join(dir, "root.grvrc")
+	if err := os.WriteFile(rootPath, []byte("include sub.grvrc\n"), 0644); err != nil {
+		t.Fatalf("Unable to write root.grvrc: %v", err)
+	}
+
+	subPath := filepath.Join(dir, "sub.grvrc")
+	if err := os.WriteFile(subPath, []byte("set included yes\n"), 0644); err != nil {
+		t.Fatalf("Unable to write sub.grvrc: %v", err)
+	}
+
+	scanner, errs := parseFile(t, rootPath)
+
+	if len(errs) != 0 {
+		t.Fatalf("expected no errors, got %v", errs)
+	}
+
+	if value, ok := scanner.lookupVariable("included"); !ok || value != "yes" {
+		t.Errorf("expected sub.grvrc to have been included and set 'included' to 'yes', got %q, %v", value, ok)
+	}
+}
+
+// TestPushIncludeDetectsDirectCycle verifies that a file including itself is caught immediately,
+// rather than only once maxIncludeDepth is exhausted
+func TestPushIncludeDetectsDirectCycle(t *testing.T) {
+	dir := t.TempDir()
+
+	rootPath := filepath.Join(dir, "root.grvrc")
+	if err := os.WriteFile(rootPath, []byte("include "+rootPath+"\n"), 0644); err != nil {
+		t.Fatalf("Unable to write root.grvrc: %v", err)
+	}
+
+	_, errs := parseFile(t, rootPath)
+
+	if len(errs) != 1 {
+		t.Fatalf("expected exactly one error, got %v: %v", len(errs), errs)
+	}
+}
+
+// TestSetMaxIncludeDepth verifies that the include depth limit can be configured rather than
+// being a fixed, unconfigurable constant
+func TestSetMaxIncludeDepth(t *testing.T) {
+	dir := t.TempDir()
+
+	rootPath := filepath.Join(dir, "root.grvrc")
+	if err := os.WriteFile(rootPath, []byte("include chain1.grvrc\n"), 0644); err != nil {
+		t.Fatalf("Unable to write root.grvrc: %v", err)
+	}
+
+	chain1Path := filepath.Join(dir, "chain1.grvrc")
+	if err := os.WriteFile(chain1Path, []byte("include chain2.grvrc\n"), 0644); err != nil {
+		t.Fatalf("Unable to write chain1.grvrc: %v", err)
+	}
+
+	chain2Path := filepath.Join(dir, "chain2.grvrc")
+	if err := os.WriteFile(chain2Path, []byte("include chain3.grvrc\n"), 0644); err != nil {
+		t.Fatalf("Unable to write chain2.grvrc: %v", err)
+	}
+
+	chain3Path := filepath.Join(dir, "chain3.grvrc")
+	if err := os.WriteFile(chain3Path, []byte("set unreachable yes\n"), 0644); err != nil {
+		t.Fatalf("Unable to write chain3.grvrc: %v", err)
+	}
+
+	file, err := os.Open(rootPath)
+	if err != nil {
+		t.Fatalf("Unable to open %v: %v", rootPath, err)
+	}
+	defer file.Close()
+
+	var errs []string
+	scanner := &ConfigScanner{}
+	scanner.Init(file, rootPath, collectErrors(&errs))
+	scanner.SetMaxIncludeDepth(2)
+
+	if _, err := NewConfigParser(scanner).Parse(); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	if len(errs) != 1 {
+		t.Fatalf("expected exactly one error, got %v: %v", len(errs), errs)
+	}
+
+	if want := "Maximum include depth of 2 exceeded"; len(errs[0]) < len(want) || errs[0][:len(want)] != want {
+		t.Errorf("expected error to report the configured depth of 2, got %q", errs[0])
+	}
+}
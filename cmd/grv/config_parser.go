@@ -0,0 +1,315 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ConfigNode is implemented by every node produced by ConfigParser and exposes the source range
+// the node was parsed from, so callers can point diagnostics or highlighting at the right place
+type ConfigNode interface {
+	Range() (start, end Position)
+}
+
+// CommandNode represents an invocation of a builtin or user-defined command, e.g.
+// "addview GitLogView" or "theme --name solarized"
+type CommandNode struct {
+	Command  string
+	Args     []string
+	StartPos Position
+	EndPos   Position
+}
+
+// Range returns the source range the node was parsed from
+func (node *CommandNode) Range() (Position, Position) { return node.StartPos, node.EndPos }
+
+// SetNode represents a `set NAME value` config command
+type SetNode struct {
+	Variable string
+	Value    string
+	StartPos Position
+	EndPos   Position
+}
+
+// Range returns the source range the node was parsed from
+func (node *SetNode) Range() (Position, Position) { return node.StartPos, node.EndPos }
+
+// BindNode represents a `map ViewContext Keys Action` key binding
+type BindNode struct {
+	ViewContext string
+	Keys        string
+	Action      string
+	StartPos    Position
+	EndPos      Position
+}
+
+// Range returns the source range the node was parsed from
+func (node *BindNode) Range() (Position, Position) { return node.StartPos, node.EndPos }
+
+// IncludeNode represents an `include path` directive. The included file's tokens have already
+// been spliced into the scanner's stream by the time this node is returned
+type IncludeNode struct {
+	Path     string
+	StartPos Position
+	EndPos   Position
+}
+
+// Range returns the source range the node was parsed from
+func (node *IncludeNode) Range() (Position, Position) { return node.StartPos, node.EndPos }
+
+// ShellNode represents a `!`/`@` shell command invocation. Quiet is true for the `@` form, which
+// suppresses the command's output
+type ShellNode struct {
+	Command  string
+	Quiet    bool
+	StartPos Position
+	EndPos   Position
+}
+
+// Range returns the source range the node was parsed from
+func (node *ShellNode) Range() (Position, Position) { return node.StartPos, node.EndPos }
+
+// IfNode represents an `if`/`elif`/`else`/`endif` conditional block. In practice ConfigScanner
+// now evaluates these directives itself (see ConfigScanner.SetGRVVersion/SetAvailableThemes and
+// CtkSkipped) and does not surface them as tokens, so the parser produces this node only as a
+// fallback, for a directive that reaches it as an ordinary word token
+type IfNode struct {
+	Condition string
+	StartPos  Position
+	EndPos    Position
+}
+
+// Range returns the source range the node was parsed from
+func (node *IfNode) Range() (Position, Position) { return node.StartPos, node.EndPos }
+
+// ConfigParser turns the token stream produced by a ConfigScanner into a sequence of ConfigNodes.
+// Malformed statements are recovered from by skipping to the next CtkTerminator, so a single
+// Parse call reports every problem in a grvrc file through the scanner's ErrorHandler rather than
+// stopping at the first one
+type ConfigParser struct {
+	scanner *ConfigScanner
+}
+
+// NewConfigParser creates a new parser which consumes tokens from the provided scanner
+func NewConfigParser(scanner *ConfigScanner) *ConfigParser {
+	return &ConfigParser{
+		scanner: scanner,
+	}
+}
+
+// Parse reads the entire token stream and returns the statements found. Errors in individual
+// statements do not abort the parse; they are reported through the scanner's ErrorHandler and
+// parsing resumes at the next statement
+func (parser *ConfigParser) Parse() (nodes []ConfigNode, err error) {
+	for {
+		var node ConfigNode
+		var eof bool
+
+		if node, eof, err = parser.parseStatement(); err != nil {
+			return
+		}
+
+		if eof {
+			return
+		}
+
+		if node != nil {
+			nodes = append(nodes, node)
+		}
+	}
+}
+
+// next returns the next token from the scanner, dropping whitespace and tokens inside an
+// inactive if/elif/else branch (CtkSkipped) so callers never see either
+func (parser *ConfigParser) next() (token *ConfigToken, err error) {
+	for {
+		if token, err = parser.scanner.Scan(); err != nil || token == nil {
+			return
+		}
+
+		if token.tokenType != CtkWhiteSpace && token.tokenType != CtkSkipped {
+			return
+		}
+	}
+}
+
+// recover reports msg at pos through the scanner's ErrorHandler and discards tokens up to and
+// including the next CtkTerminator, so the parser can resume at the next statement
+func (parser *ConfigParser) recover(msg string, pos Position) {
+	parser.scanner.error(pos, msg)
+
+	for {
+		token, err := parser.next()
+		if err != nil || token.tokenType == CtkEOF || token.tokenType == CtkTerminator {
+			return
+		}
+	}
+}
+
+func (parser *ConfigParser) parseStatement() (node ConfigNode, eof bool, err error) {
+	token, err := parser.next()
+	if err != nil {
+		return
+	}
+
+	switch token.tokenType {
+	case CtkEOF:
+		eof = true
+	case CtkTerminator, CtkComment:
+		return parser.parseStatement()
+	case CtkShellCommand:
+		node = &ShellNode{
+			Command:  strings.TrimPrefix(strings.TrimPrefix(token.value, "@"), "!"),
+			Quiet:    strings.HasPrefix(token.value, "@"),
+			StartPos: token.startPos,
+			EndPos:   token.endPos,
+		}
+	case CtkWord:
+		node, eof, err = parser.parseWordStatement(token)
+	default:
+		parser.recover(fmt.Sprintf("Unexpected token: %v", ConfigTokenName(token.tokenType)), token.startPos)
+		return parser.parseStatement()
+	}
+
+	return
+}
+
+func (parser *ConfigParser) parseWordStatement(first *ConfigToken) (node ConfigNode, eof bool, err error) {
+	switch first.value {
+	case "set":
+		return parser.parseSet(first)
+	case "include":
+		return parser.parseInclude(first)
+	case "map":
+		return parser.parseBind(first)
+	case "if", "elif", "else", "endif":
+		// Normally intercepted and fully evaluated by the scanner before reaching here; handled
+		// as a fallback in case a token stream from elsewhere surfaces one directly
+		return parser.parseIf(first)
+	default:
+		return parser.parseCommand(first)
+	}
+}
+
+// restOfStatement collects the remaining word/option values on the current line
+func (parser *ConfigParser) restOfStatement() (args []string, endPos Position, err error) {
+	for {
+		var token *ConfigToken
+		if token, err = parser.next(); err != nil {
+			return
+		}
+
+		switch token.tokenType {
+		case CtkEOF, CtkTerminator, CtkComment:
+			endPos = token.startPos
+			return
+		case CtkInvalid:
+			parser.scanner.error(token.startPos, fmt.Sprintf("Invalid token: %v", token.value))
+		default:
+			args = append(args, token.value)
+			endPos = token.endPos
+		}
+	}
+}
+
+func (parser *ConfigParser) parseSet(first *ConfigToken) (node ConfigNode, eof bool, err error) {
+	args, endPos, err := parser.restOfStatement()
+	if err != nil {
+		return
+	}
+
+	if len(args) < 2 {
+		// restOfStatement has already consumed the statement, so there is nothing to skip
+		parser.scanner.error(first.startPos, "set requires a variable name and a value")
+		return
+	}
+
+	setNode := &SetNode{
+		Variable: args[0],
+		Value:    strings.Join(args[1:], " "),
+		StartPos: first.startPos,
+		EndPos:   endPos,
+	}
+
+	parser.scanner.SetVariable(setNode.Variable, setNode.Value)
+	node = setNode
+
+	return
+}
+
+func (parser *ConfigParser) parseInclude(first *ConfigToken) (node ConfigNode, eof bool, err error) {
+	args, endPos, err := parser.restOfStatement()
+	if err != nil {
+		return
+	}
+
+	if len(args) != 1 {
+		parser.scanner.error(first.startPos, "include requires exactly one path argument")
+		return
+	}
+
+	if _, err = parser.scanner.PushInclude(args[0]); err != nil {
+		return
+	}
+
+	node = &IncludeNode{
+		Path:     args[0],
+		StartPos: first.startPos,
+		EndPos:   endPos,
+	}
+
+	return
+}
+
+func (parser *ConfigParser) parseBind(first *ConfigToken) (node ConfigNode, eof bool, err error) {
+	args, endPos, err := parser.restOfStatement()
+	if err != nil {
+		return
+	}
+
+	if len(args) < 3 {
+		parser.scanner.error(first.startPos, "map requires a view context, a key sequence and an action")
+		return
+	}
+
+	node = &BindNode{
+		ViewContext: args[0],
+		Keys:        args[1],
+		Action:      strings.Join(args[2:], " "),
+		StartPos:    first.startPos,
+		EndPos:      endPos,
+	}
+
+	return
+}
+
+func (parser *ConfigParser) parseIf(first *ConfigToken) (node ConfigNode, eof bool, err error) {
+	args, endPos, err := parser.restOfStatement()
+	if err != nil {
+		return
+	}
+
+	node = &IfNode{
+		Condition: strings.Join(args, " "),
+		StartPos:  first.startPos,
+		EndPos:    endPos,
+	}
+
+	return
+}
+
+func (parser *ConfigParser) parseCommand(first *ConfigToken) (node ConfigNode, eof bool, err error) {
+	args, endPos, err := parser.restOfStatement()
+	if err != nil {
+		return
+	}
+
+	node = &CommandNode{
+		Command:  first.value,
+		Args:     args,
+		StartPos: first.startPos,
+		EndPos:   endPos,
+	}
+
+	return
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestPeekNDoesNotConsumeTokens verifies PeekN returns the upcoming tokens without advancing the
+// stream, and that a subsequent Scan still returns the first of them
+func TestPeekNDoesNotConsumeTokens(t *testing.T) {
+	scanner := NewConfigScanner(strings.NewReader("wordA wordB"))
+
+	peeked, err := scanner.PeekN(3)
+	if err != nil {
+		t.Fatalf("PeekN failed: %v", err)
+	}
+
+	if len(peeked) != 3 || peeked[0].value != "wordA" || peeked[1].tokenType != CtkWhiteSpace || peeked[2].value != "wordB" {
+		t.Fatalf("unexpected peeked tokens: %+v", peeked)
+	}
+
+	token, err := scanner.Scan()
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+
+	if token.value != "wordA" {
+		t.Errorf("expected Scan to still return wordA after PeekN, got %q", token.value)
+	}
+}
+
+// TestPeekNAtEOFReturnsFewerTokens verifies PeekN returns fewer than n tokens, ending in CtkEOF,
+// once the stream is exhausted before n tokens are available
+func TestPeekNAtEOFReturnsFewerTokens(t *testing.T) {
+	scanner := NewConfigScanner(strings.NewReader("wordA"))
+
+	peeked, err := scanner.PeekN(5)
+	if err != nil {
+		t.Fatalf("PeekN failed: %v", err)
+	}
+
+	if len(peeked) != 2 {
+		t.Fatalf("expected 2 tokens (wordA, EOF), got %v: %+v", len(peeked), peeked)
+	}
+
+	if peeked[len(peeked)-1].tokenType != CtkEOF {
+		t.Errorf("expected the final peeked token to be CtkEOF, got %v", peeked[len(peeked)-1].tokenType)
+	}
+}
+
+// TestUnscanIsLIFO verifies tokens pushed back via Unscan are replayed in LIFO order on
+// subsequent Scan calls
+func TestUnscanIsLIFO(t *testing.T) {
+	scanner := NewConfigScanner(strings.NewReader("wordA"))
+
+	first, err := scanner.Scan()
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+
+	second := &ConfigToken{tokenType: CtkWord, value: "pushed"}
+
+	scanner.Unscan(first)
+	scanner.Unscan(second)
+
+	token, err := scanner.Scan()
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+
+	if token.value != "pushed" {
+		t.Errorf("expected the most recently unscanned token first, got %q", token.value)
+	}
+
+	token, err = scanner.Scan()
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+
+	if token.value != "wordA" {
+		t.Errorf("expected the earlier unscanned token next, got %q", token.value)
+	}
+}
+
+// parse scans and parses input, returning the nodes produced and any messages reported through
+// the ErrorHandler
+func parse(t *testing.T, input string) ([]ConfigNode, []string) {
+	t.Helper()
+
+	var errs []string
+	scanner := &ConfigScanner{}
+	scanner.Init(strings.NewReader(input), "", collectErrors(&errs))
+
+	nodes, err := NewConfigParser(scanner).Parse()
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	return nodes, errs
+}
+
+// TestParserProducesExpectedNodeTypes verifies each statement form parses to the node type and
+// fields the parser is documented to produce
+func TestParserProducesExpectedNodeTypes(t *testing.T) {
+	input := "addview GitLogView\nset foo bar\nmap GitLogView a b\n!echo hi\n@echo quiet\n"
+
+	nodes, errs := parse(t, input)
+
+	if len(errs) != 0 {
+		t.Fatalf("expected no errors, got %v", errs)
+	}
+
+	if len(nodes) != 5 {
+		t.Fatalf("expected 5 nodes, got %v: %+v", len(nodes), nodes)
+	}
+
+	cmd, ok := nodes[0].(*CommandNode)
+	if !ok || cmd.Command != "addview" || len(cmd.Args) != 1 || cmd.Args[0] != "GitLogView" {
+		t.Errorf("unexpected CommandNode: %+v", nodes[0])
+	}
+
+	set, ok := nodes[1].(*SetNode)
+	if !ok || set.Variable != "foo" || set.Value != "bar" {
+		t.Errorf("unexpected SetNode: %+v", nodes[1])
+	}
+
+	bind, ok := nodes[2].(*BindNode)
+	if !ok || bind.ViewContext != "GitLogView" || bind.Keys != "a" || bind.Action != "b" {
+		t.Errorf("unexpected BindNode: %+v", nodes[2])
+	}
+
+	loud, ok := nodes[3].(*ShellNode)
+	if !ok || loud.Command != "echo hi" || loud.Quiet {
+		t.Errorf("unexpected loud ShellNode: %+v", nodes[3])
+	}
+
+	quiet, ok := nodes[4].(*ShellNode)
+	if !ok || quiet.Command != "echo quiet" || !quiet.Quiet {
+		t.Errorf("unexpected quiet ShellNode: %+v", nodes[4])
+	}
+}
+
+// TestParserRecoversFromMalformedStatement verifies a statement starting with an unexpected
+// token (here, a bare "--option" with no preceding command) is reported through the
+// ErrorHandler and parsing resumes at the next statement, rather than the whole Parse call
+// aborting
+func TestParserRecoversFromMalformedStatement(t *testing.T) {
+	nodes, errs := parse(t, "--badopt\naddview GitLogView\n")
+
+	if len(errs) != 1 {
+		t.Fatalf("expected exactly one error, got %v: %v", len(errs), errs)
+	}
+
+	if len(nodes) != 1 {
+		t.Fatalf("expected parsing to recover and still produce the following statement, got %+v", nodes)
+	}
+
+	cmd, ok := nodes[0].(*CommandNode)
+	if !ok || cmd.Command != "addview" {
+		t.Errorf("unexpected node after recovery: %+v", nodes[0])
+	}
+}
@@ -3,13 +3,19 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"errors"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"unicode"
 )
 
+// defaultMaxIncludeDepth is the maximum number of nested includes the scanner will follow before
+// reporting an error, guarding against runaway inclusion, unless overridden via SetMaxIncludeDepth
+const defaultMaxIncludeDepth = 32
+
 // ConfigTokenType is an enum of token types the config scanner can produce
 type ConfigTokenType uint
 
@@ -23,6 +29,7 @@ const (
 	CtkShellCommand
 	CtkTerminator
 	CtkEOF
+	CtkSkipped
 
 	CtkCount
 )
@@ -36,30 +43,92 @@ var configTokenNames = map[ConfigTokenType]string{
 	CtkShellCommand: "Shell Command",
 	CtkTerminator:   "Terminator",
 	CtkEOF:          "EOF",
+	CtkSkipped:      "Skipped",
 }
 
-// ConfigScannerPos represents a position in the config scanner input stream
-type ConfigScannerPos struct {
-	line uint
-	col  uint
+// Position represents a location in a config source file, modeled on go/token.Position
+type Position struct {
+	Filename string
+	Offset   int
+	Line     int
+	Column   int
 }
 
+// String formats the position in a form suitable for error messages
+func (pos Position) String() string {
+	if pos.Filename == "" {
+		return fmt.Sprintf("%d:%d", pos.Line, pos.Column)
+	}
+
+	return fmt.Sprintf("%v:%d:%d", pos.Filename, pos.Line, pos.Column)
+}
+
+// ErrorHandler is invoked by the scanner for each error encountered while scanning, allowing
+// callers to accumulate every diagnostic from a single parse rather than aborting on the first
+type ErrorHandler func(pos Position, msg string)
+
 // ConfigToken is a config token parsed from an input stream
-// It contains position, error and value data
+// It contains position and value data
 type ConfigToken struct {
 	tokenType ConfigTokenType
 	value     string
-	startPos  ConfigScannerPos
-	endPos    ConfigScannerPos
-	err       error
+	startPos  Position
+	endPos    Position
 }
 
 // ConfigScanner scans an input stream and generates a stream of config tokens
 type ConfigScanner struct {
 	reader          *bufio.Reader
-	pos             ConfigScannerPos
+	filename        string
+	pos             Position
 	lastCharLineEnd bool
-	lastLineEndCol  uint
+	lastLineEndCol  int
+	lastCharWidth   int
+	errorHandler    ErrorHandler
+
+	file            *os.File
+	canonicalPath   string
+	includes        []configScannerInclude
+	includePaths    map[string]bool
+	maxIncludeDepth int
+
+	variables    map[string]string
+	builtins     map[string]string
+	strictExpand bool
+
+	tokenBuffer []*ConfigToken
+
+	atStatementStart bool
+	conditions       []configConditionFrame
+	grvVersion       string
+	availableThemes  map[string]bool
+
+	// ErrorCount is the number of errors reported so far, whether or not an ErrorHandler is installed
+	ErrorCount int
+}
+
+// configConditionFrame tracks one level of if/elif/else nesting while scanning. matched records
+// whether some branch of this if-chain has already been taken, so later elif/else branches in
+// the chain are skipped even if their own condition would otherwise hold. active records whether
+// the branch currently being scanned should be yielded to the caller or reported as CtkSkipped
+type configConditionFrame struct {
+	matched bool
+	active  bool
+}
+
+// configScannerInclude captures the state of an outer file suspended while an included file is
+// being scanned, so that Scan can transparently resume it once the included file is exhausted
+type configScannerInclude struct {
+	reader           *bufio.Reader
+	file             *os.File
+	filename         string
+	canonicalPath    string
+	pos              Position
+	lastCharLineEnd  bool
+	lastLineEndCol   int
+	lastCharWidth    int
+	atStatementStart bool
+	conditions       []configConditionFrame
 }
 
 // Equal returns true if the other token is equal
@@ -71,10 +140,7 @@ func (token *ConfigToken) Equal(other *ConfigToken) bool {
 	return token.tokenType == other.tokenType &&
 		token.value == other.value &&
 		token.startPos == other.startPos &&
-		token.endPos == other.endPos &&
-		((token.err == nil && other.err == nil) ||
-			(token.err != nil && other.err != nil &&
-				token.err.Error() == other.err.Error()))
+		token.endPos == other.endPos
 }
 
 // ConfigTokenName maps token types to human readable names
@@ -92,32 +158,651 @@ func ConfigTokenName(tokenType ConfigTokenType) string {
 
 // NewConfigScanner creates a new scanner which uses the provided reader
 func NewConfigScanner(reader io.Reader) *ConfigScanner {
-	return &ConfigScanner{
-		reader: bufio.NewReader(reader),
-		pos: ConfigScannerPos{
-			line: 1,
-			col:  0,
-		},
+	scanner := &ConfigScanner{}
+	scanner.Init(reader, "", nil)
+	return scanner
+}
+
+// Init (re-)initialises the scanner to read from the provided reader. filename is attached to
+// every position the scanner produces, and handler, if non-nil, is invoked for every error
+// encountered while scanning, allowing a caller to accumulate all the errors in a single pass
+// over a grvrc file rather than stopping at the first one
+func (scanner *ConfigScanner) Init(reader io.Reader, filename string, handler ErrorHandler) {
+	scanner.reader = bufio.NewReader(reader)
+	scanner.filename = filename
+	scanner.errorHandler = handler
+	scanner.lastCharLineEnd = false
+	scanner.lastLineEndCol = 0
+	scanner.lastCharWidth = 0
+	scanner.ErrorCount = 0
+	scanner.file = nil
+	scanner.canonicalPath = ""
+	scanner.includes = nil
+	scanner.includePaths = nil
+	scanner.tokenBuffer = nil
+
+	if filename != "" {
+		if canonicalPath, err := filepath.Abs(filename); err == nil {
+			scanner.canonicalPath = canonicalPath
+			scanner.includePaths = map[string]bool{canonicalPath: true}
+		}
+	}
+
+	scanner.atStatementStart = true
+	scanner.conditions = nil
+	scanner.pos = Position{
+		Filename: filename,
+		Line:     1,
+		Column:   0,
+	}
+}
+
+// PushInclude suspends scanning of the current input and begins scanning path instead; once the
+// included file is exhausted, Scan transparently resumes the outer input. An include cycle or a
+// nesting depth beyond the configured max include depth (see SetMaxIncludeDepth) is reported
+// through the ErrorHandler and yields a CtkInvalid token rather than being followed. A relative
+// path is resolved against the directory of the file containing the include directive
+func (scanner *ConfigScanner) PushInclude(path string) (token *ConfigToken, err error) {
+	depthLimit := scanner.includeDepthLimit()
+	if len(scanner.includes) >= depthLimit {
+		scanner.error(scanner.pos, fmt.Sprintf("Maximum include depth of %v exceeded while including %v", depthLimit, path))
+		return &ConfigToken{tokenType: CtkInvalid, value: path, startPos: scanner.pos, endPos: scanner.pos}, nil
+	}
+
+	resolvedPath := path
+	if !filepath.IsAbs(resolvedPath) {
+		resolvedPath = filepath.Join(filepath.Dir(scanner.canonicalPath), resolvedPath)
+	}
+
+	canonicalPath, err := filepath.Abs(resolvedPath)
+	if err != nil {
+		scanner.error(scanner.pos, fmt.Sprintf("Unable to resolve include path %v: %v", path, err))
+		return &ConfigToken{tokenType: CtkInvalid, value: path, startPos: scanner.pos, endPos: scanner.pos}, nil
+	}
+
+	if scanner.includePaths[canonicalPath] {
+		scanner.error(scanner.pos, fmt.Sprintf("Include cycle detected: %v is already being included", path))
+		return &ConfigToken{tokenType: CtkInvalid, value: path, startPos: scanner.pos, endPos: scanner.pos}, nil
+	}
+
+	file, err := os.Open(canonicalPath)
+	if err != nil {
+		scanner.error(scanner.pos, fmt.Sprintf("Unable to include %v: %v", path, err))
+		return &ConfigToken{tokenType: CtkInvalid, value: path, startPos: scanner.pos, endPos: scanner.pos}, nil
+	}
+
+	scanner.includes = append(scanner.includes, configScannerInclude{
+		reader:           scanner.reader,
+		file:             scanner.file,
+		filename:         scanner.filename,
+		canonicalPath:    scanner.canonicalPath,
+		pos:              scanner.pos,
+		lastCharLineEnd:  scanner.lastCharLineEnd,
+		lastLineEndCol:   scanner.lastLineEndCol,
+		lastCharWidth:    scanner.lastCharWidth,
+		atStatementStart: scanner.atStatementStart,
+		conditions:       scanner.conditions,
+	})
+
+	if scanner.includePaths == nil {
+		scanner.includePaths = make(map[string]bool)
+	}
+	scanner.includePaths[canonicalPath] = true
+
+	scanner.reader = bufio.NewReader(file)
+	scanner.file = file
+	scanner.filename = path
+	scanner.canonicalPath = canonicalPath
+	scanner.lastCharLineEnd = false
+	scanner.lastLineEndCol = 0
+	scanner.lastCharWidth = 0
+	scanner.atStatementStart = true
+	scanner.conditions = nil
+	scanner.pos = Position{
+		Filename: path,
+		Line:     1,
+		Column:   0,
+	}
+
+	return
+}
+
+// SetVariable defines a user variable, set via the config `set NAME value` command, available
+// for expansion as $NAME or ${NAME} in subsequently scanned words
+func (scanner *ConfigScanner) SetVariable(name, value string) {
+	if scanner.variables == nil {
+		scanner.variables = make(map[string]string)
+	}
+
+	scanner.variables[name] = value
+}
+
+// SetBuiltinVariables installs the built-in variables (e.g. GRV_REPO, GRV_HEAD, GRV_BRANCH) made
+// available for expansion, replacing any previously installed built-ins
+func (scanner *ConfigScanner) SetBuiltinVariables(builtins map[string]string) {
+	scanner.builtins = builtins
+}
+
+// SetStrictExpansion controls how an unresolved $NAME or ${NAME} reference is handled: false (the
+// default) expands it to the empty string, true reports it as an error through the ErrorHandler
+func (scanner *ConfigScanner) SetStrictExpansion(strict bool) {
+	scanner.strictExpand = strict
+}
+
+// SetMaxIncludeDepth overrides the maximum number of nested includes the scanner will follow
+// before reporting an error and refusing to follow further includes. A value <= 0 restores the
+// default (defaultMaxIncludeDepth)
+func (scanner *ConfigScanner) SetMaxIncludeDepth(depth int) {
+	scanner.maxIncludeDepth = depth
+}
+
+// includeDepthLimit returns the configured maximum include depth, falling back to
+// defaultMaxIncludeDepth when none has been set
+func (scanner *ConfigScanner) includeDepthLimit() int {
+	if scanner.maxIncludeDepth <= 0 {
+		return defaultMaxIncludeDepth
+	}
+
+	return scanner.maxIncludeDepth
+}
+
+// lookupVariable resolves name against user-defined variables, then built-ins, then the
+// environment, in that order of precedence
+func (scanner *ConfigScanner) lookupVariable(name string) (string, bool) {
+	if value, ok := scanner.variables[name]; ok {
+		return value, true
+	}
+
+	if value, ok := scanner.builtins[name]; ok {
+		return value, true
+	}
+
+	return os.LookupEnv(name)
+}
+
+// expandVariables resolves $NAME and ${NAME} references in word. $$ always yields a literal $.
+// An unresolved reference expands to the empty string; when strict expansion is enabled it is
+// also reported at pos through the ErrorHandler
+func (scanner *ConfigScanner) expandVariables(word string, pos Position) string {
+	if !strings.ContainsRune(word, '$') {
+		return word
+	}
+
+	var buffer bytes.Buffer
+	chars := []rune(word)
+
+	for i := 0; i < len(chars); i++ {
+		char := chars[i]
+
+		if char != '$' {
+			buffer.WriteRune(char)
+			continue
+		}
+
+		if i+1 >= len(chars) {
+			buffer.WriteRune(char)
+			break
+		}
+
+		if chars[i+1] == '$' {
+			buffer.WriteRune('$')
+			i++
+			continue
+		}
+
+		var name string
+
+		if chars[i+1] == '{' {
+			end := i + 2
+			for end < len(chars) && chars[end] != '}' {
+				end++
+			}
+
+			if end >= len(chars) {
+				buffer.WriteRune(char)
+				continue
+			}
+
+			name = string(chars[i+2 : end])
+			i = end
+		} else {
+			end := i + 1
+			for end < len(chars) && (unicode.IsLetter(chars[end]) || unicode.IsDigit(chars[end]) || chars[end] == '_') {
+				end++
+			}
+
+			if end == i+1 {
+				buffer.WriteRune(char)
+				continue
+			}
+
+			name = string(chars[i+1 : end])
+			i = end - 1
+		}
+
+		value, ok := scanner.lookupVariable(name)
+		if !ok {
+			if scanner.strictExpand {
+				scanner.error(pos, fmt.Sprintf("Undefined variable: %v", name))
+			}
+			continue
+		}
+
+		buffer.WriteString(value)
+	}
+
+	return buffer.String()
+}
+
+// SetGRVVersion sets the version string tested by the "grv-version" predicate in if/elif
+// conditions, e.g. "0.4"
+func (scanner *ConfigScanner) SetGRVVersion(version string) {
+	scanner.grvVersion = version
+}
+
+// SetAvailableThemes sets the themes tested by the "has-theme" predicate in if/elif conditions
+func (scanner *ConfigScanner) SetAvailableThemes(themes map[string]bool) {
+	scanner.availableThemes = themes
+}
+
+func isConditionalKeyword(word string) bool {
+	switch word {
+	case "if", "elif", "else", "endif":
+		return true
+	default:
+		return false
+	}
+}
+
+// updateStatementStart tracks whether the next token scanned will be the first token of a new
+// statement, which is where an if/elif/else/endif directive is recognised
+func (scanner *ConfigScanner) updateStatementStart(token *ConfigToken) {
+	switch token.tokenType {
+	case CtkWhiteSpace:
+	case CtkTerminator, CtkComment:
+		scanner.atStatementStart = true
+	default:
+		scanner.atStatementStart = false
+	}
+}
+
+// conditionsActive returns true if every enclosing if/elif/else branch is currently active, i.e.
+// tokens scanned right now should be yielded normally rather than as CtkSkipped
+func (scanner *ConfigScanner) conditionsActive() bool {
+	for _, frame := range scanner.conditions {
+		if !frame.active {
+			return false
+		}
+	}
+
+	return true
+}
+
+// outerConditionsActive is like conditionsActive but ignores the innermost frame, which is the
+// one elif/else are about to update
+func (scanner *ConfigScanner) outerConditionsActive() bool {
+	for _, frame := range scanner.conditions[:len(scanner.conditions)-1] {
+		if !frame.active {
+			return false
+		}
+	}
+
+	return true
+}
+
+// handleConditional consumes the remainder of an if/elif/else/endif line and updates the
+// condition stack accordingly. The directive itself never becomes a token in the stream
+func (scanner *ConfigScanner) handleConditional(directiveToken *ConfigToken) (err error) {
+	var tokens []string
+
+ScanLine:
+	for {
+		// lexToken takes a '!' for the start of a shell command running to the end of the line,
+		// so the "!" and "!=" operators are read here instead
+		if next, _ := scanner.reader.Peek(2); len(next) > 0 && next[0] == '!' {
+			op := "!"
+			if len(next) > 1 && next[1] == '=' {
+				op = "!="
+			}
+			for range op {
+				if _, _, err = scanner.read(); err != nil {
+					return
+				}
+			}
+			tokens = append(tokens, op)
+			continue
+		}
+
+		var token *ConfigToken
+		if token, err = scanner.lexToken(); err != nil {
+			return
+		}
+
+		switch token.tokenType {
+		case CtkEOF, CtkTerminator, CtkComment:
+			scanner.atStatementStart = true
+			break ScanLine
+		case CtkWhiteSpace:
+		default:
+			tokens = append(tokens, token.value)
+		}
+	}
+
+	switch directiveToken.value {
+	case "if":
+		scanner.pushCondition(tokens, directiveToken.startPos)
+	case "elif":
+		scanner.elifCondition(tokens, directiveToken.startPos)
+	case "else":
+		scanner.elseCondition(directiveToken.startPos)
+	case "endif":
+		scanner.endifCondition(directiveToken.startPos)
+	}
+
+	return
+}
+
+func (scanner *ConfigScanner) pushCondition(tokens []string, pos Position) {
+	frame := configConditionFrame{}
+
+	if !scanner.conditionsActive() {
+		// An if nested inside an inactive branch is never taken, regardless of its own condition
+		frame.matched = true
+	} else if result, err := scanner.evaluateCondition(tokens); err != nil {
+		scanner.error(pos, fmt.Sprintf("Invalid if condition: %v", err))
+	} else {
+		frame.active = result
+		frame.matched = result
+	}
+
+	scanner.conditions = append(scanner.conditions, frame)
+}
+
+func (scanner *ConfigScanner) elifCondition(tokens []string, pos Position) {
+	if len(scanner.conditions) == 0 {
+		scanner.error(pos, "elif without matching if")
+		return
+	}
+
+	frame := &scanner.conditions[len(scanner.conditions)-1]
+
+	if !scanner.outerConditionsActive() || frame.matched {
+		frame.active = false
+		return
+	}
+
+	result, err := scanner.evaluateCondition(tokens)
+	if err != nil {
+		scanner.error(pos, fmt.Sprintf("Invalid elif condition: %v", err))
+		frame.active = false
+		return
+	}
+
+	frame.active = result
+	if result {
+		frame.matched = true
+	}
+}
+
+func (scanner *ConfigScanner) elseCondition(pos Position) {
+	if len(scanner.conditions) == 0 {
+		scanner.error(pos, "else without matching if")
+		return
+	}
+
+	frame := &scanner.conditions[len(scanner.conditions)-1]
+
+	frame.active = scanner.outerConditionsActive() && !frame.matched
+	frame.matched = true
+}
+
+func (scanner *ConfigScanner) endifCondition(pos Position) {
+	if len(scanner.conditions) == 0 {
+		scanner.error(pos, "endif without matching if")
+		return
+	}
+
+	scanner.conditions = scanner.conditions[:len(scanner.conditions)-1]
+}
+
+// evaluateCondition evaluates a flat boolean expression over tokens already split on whitespace
+// by the scanner. Supported predicates are "has-theme NAME", "env NAME (== or !=) VALUE" and
+// "grv-version OP VERSION" (OP one of == != < <= > >=). Predicates combine with "&&", "||" and a
+// prefix "!", with && binding tighter than ||. Parenthesised grouping is not supported
+func (scanner *ConfigScanner) evaluateCondition(tokens []string) (result bool, err error) {
+	if len(tokens) == 0 {
+		return false, fmt.Errorf("Empty condition")
+	}
+
+	pos := 0
+
+	var parseOr, parseAnd, parseUnary func() (bool, error)
+
+	parseOr = func() (bool, error) {
+		left, err := parseAnd()
+		if err != nil {
+			return false, err
+		}
+
+		for pos < len(tokens) && tokens[pos] == "||" {
+			pos++
+
+			right, err := parseAnd()
+			if err != nil {
+				return false, err
+			}
+
+			left = left || right
+		}
+
+		return left, nil
+	}
+
+	parseAnd = func() (bool, error) {
+		left, err := parseUnary()
+		if err != nil {
+			return false, err
+		}
+
+		for pos < len(tokens) && tokens[pos] == "&&" {
+			pos++
+
+			right, err := parseUnary()
+			if err != nil {
+				return false, err
+			}
+
+			left = left && right
+		}
+
+		return left, nil
+	}
+
+	parseUnary = func() (bool, error) {
+		negate := false
+
+		for pos < len(tokens) && tokens[pos] == "!" {
+			negate = !negate
+			pos++
+		}
+
+		value, err := scanner.evaluatePredicate(tokens, &pos)
+		if err != nil {
+			return false, err
+		}
+
+		return value != negate, nil
+	}
+
+	if result, err = parseOr(); err != nil {
+		return false, err
+	}
+
+	if pos != len(tokens) {
+		return false, fmt.Errorf("Unexpected token in condition: %v", tokens[pos])
+	}
+
+	return result, nil
+}
+
+func (scanner *ConfigScanner) evaluatePredicate(tokens []string, pos *int) (bool, error) {
+	if *pos >= len(tokens) {
+		return false, fmt.Errorf("Expected a predicate")
+	}
+
+	switch tokens[*pos] {
+	case "has-theme":
+		if *pos+1 >= len(tokens) {
+			return false, fmt.Errorf("has-theme requires a theme name")
+		}
+
+		name := tokens[*pos+1]
+		*pos += 2
+
+		return scanner.availableThemes[name], nil
+	case "env":
+		if *pos+3 >= len(tokens) {
+			return false, fmt.Errorf("env requires the form: env NAME (== or !=) VALUE")
+		}
+
+		name, op, expected := tokens[*pos+1], tokens[*pos+2], tokens[*pos+3]
+		*pos += 4
+		actual, _ := scanner.lookupVariable(name)
+
+		switch op {
+		case "==":
+			return actual == expected, nil
+		case "!=":
+			return actual != expected, nil
+		default:
+			return false, fmt.Errorf("Unsupported env operator: %v", op)
+		}
+	case "grv-version":
+		if *pos+2 >= len(tokens) {
+			return false, fmt.Errorf("grv-version requires the form: grv-version OP VERSION")
+		}
+
+		op, version := tokens[*pos+1], tokens[*pos+2]
+		*pos += 3
+
+		cmp, err := compareVersions(scanner.grvVersion, version)
+		if err != nil {
+			return false, err
+		}
+
+		switch op {
+		case "==":
+			return cmp == 0, nil
+		case "!=":
+			return cmp != 0, nil
+		case "<":
+			return cmp < 0, nil
+		case "<=":
+			return cmp <= 0, nil
+		case ">":
+			return cmp > 0, nil
+		case ">=":
+			return cmp >= 0, nil
+		default:
+			return false, fmt.Errorf("Unsupported grv-version operator: %v", op)
+		}
+	default:
+		return false, fmt.Errorf("Unknown predicate: %v", tokens[*pos])
+	}
+}
+
+// compareVersions compares two dotted numeric version strings (e.g. "0.4", "1.2.3"), returning
+// -1, 0 or 1 as a is less than, equal to or greater than b
+func compareVersions(a, b string) (int, error) {
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		var aVal, bVal int
+		var err error
+
+		if i < len(aParts) {
+			if aVal, err = strconv.Atoi(aParts[i]); err != nil {
+				return 0, fmt.Errorf("Invalid version: %v", a)
+			}
+		}
+
+		if i < len(bParts) {
+			if bVal, err = strconv.Atoi(bParts[i]); err != nil {
+				return 0, fmt.Errorf("Invalid version: %v", b)
+			}
+		}
+
+		if aVal != bVal {
+			if aVal < bVal {
+				return -1, nil
+			}
+
+			return 1, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// popInclude closes the file currently being scanned and resumes scanning the outer file that
+// included it
+func (scanner *ConfigScanner) popInclude() {
+	if len(scanner.conditions) > 0 {
+		scanner.error(scanner.pos, "Unterminated if in included file")
+	}
+
+	last := len(scanner.includes) - 1
+	frame := scanner.includes[last]
+	scanner.includes = scanner.includes[:last]
+
+	if scanner.file != nil {
+		scanner.file.Close()
+	}
+
+	delete(scanner.includePaths, scanner.canonicalPath)
+
+	scanner.reader = frame.reader
+	scanner.file = frame.file
+	scanner.filename = frame.filename
+	scanner.canonicalPath = frame.canonicalPath
+	scanner.pos = frame.pos
+	scanner.lastCharLineEnd = frame.lastCharLineEnd
+	scanner.lastLineEndCol = frame.lastLineEndCol
+	scanner.lastCharWidth = frame.lastCharWidth
+	scanner.atStatementStart = frame.atStatementStart
+	scanner.conditions = frame.conditions
+}
+
+// error reports msg at pos through the ErrorHandler, if one is installed, and increments ErrorCount
+func (scanner *ConfigScanner) error(pos Position, msg string) {
+	scanner.ErrorCount++
+
+	if scanner.errorHandler != nil {
+		scanner.errorHandler(pos, msg)
 	}
 }
 
 func (scanner *ConfigScanner) read() (char rune, eof bool, err error) {
-	char, _, err = scanner.reader.ReadRune()
+	char, width, err := scanner.reader.ReadRune()
 
 	if err == io.EOF {
 		eof = true
 		err = nil
 
-		if scanner.pos.col == 0 {
-			scanner.pos.col = 1
+		if scanner.pos.Column == 0 {
+			scanner.pos.Column = 1
 		}
 	} else if err == nil {
+		scanner.lastCharWidth = width
+		scanner.pos.Offset += width
+
 		if scanner.lastCharLineEnd {
-			scanner.lastLineEndCol = scanner.pos.col
-			scanner.pos.line++
-			scanner.pos.col = 1
+			scanner.lastLineEndCol = scanner.pos.Column
+			scanner.pos.Line++
+			scanner.pos.Column = 1
 		} else {
-			scanner.pos.col++
+			scanner.pos.Column++
 		}
 
 		scanner.lastCharLineEnd = (char == '\n')
@@ -131,12 +816,14 @@ func (scanner *ConfigScanner) unread() (err error) {
 		return
 	}
 
-	if scanner.pos.line > 1 && scanner.pos.col == 1 {
-		scanner.pos.line--
-		scanner.pos.col = scanner.lastLineEndCol
+	scanner.pos.Offset -= scanner.lastCharWidth
+
+	if scanner.pos.Line > 1 && scanner.pos.Column == 1 {
+		scanner.pos.Line--
+		scanner.pos.Column = scanner.lastLineEndCol
 		scanner.lastCharLineEnd = true
 	} else {
-		scanner.pos.col--
+		scanner.pos.Column--
 		scanner.lastCharLineEnd = false
 	}
 
@@ -145,12 +832,91 @@ func (scanner *ConfigScanner) unread() (err error) {
 
 // Scan returns the next token from the input stream
 func (scanner *ConfigScanner) Scan() (token *ConfigToken, err error) {
+	if len(scanner.tokenBuffer) > 0 {
+		token = scanner.tokenBuffer[0]
+		scanner.tokenBuffer = scanner.tokenBuffer[1:]
+		return
+	}
+
+	return scanner.scanNext()
+}
+
+// PeekN returns, without consuming, the next n tokens in the stream. Fewer than n tokens are
+// returned if the stream is exhausted first (the final token will be a CtkEOF token)
+func (scanner *ConfigScanner) PeekN(n int) (tokens []*ConfigToken, err error) {
+	for len(scanner.tokenBuffer) < n {
+		var token *ConfigToken
+		if token, err = scanner.scanNext(); err != nil {
+			return
+		}
+
+		scanner.tokenBuffer = append(scanner.tokenBuffer, token)
+
+		if token.tokenType == CtkEOF {
+			break
+		}
+	}
+
+	if n > len(scanner.tokenBuffer) {
+		n = len(scanner.tokenBuffer)
+	}
+
+	tokens = make([]*ConfigToken, n)
+	copy(tokens, scanner.tokenBuffer[:n])
+
+	return
+}
+
+// Unscan pushes token back onto the front of the stream, so that the next call to Scan or PeekN
+// returns it again. Tokens are unscanned in LIFO order
+func (scanner *ConfigScanner) Unscan(token *ConfigToken) {
+	scanner.tokenBuffer = append([]*ConfigToken{token}, scanner.tokenBuffer...)
+}
+
+// scanNext returns the next token, evaluating any if/elif/else/endif directive and retyping
+// tokens inside an inactive conditional branch as CtkSkipped, bypassing the peek buffer
+func (scanner *ConfigScanner) scanNext() (token *ConfigToken, err error) {
+	for {
+		if token, err = scanner.lexToken(); err != nil || token == nil || token.tokenType == CtkEOF {
+			return
+		}
+
+		if scanner.atStatementStart && token.tokenType == CtkWord && isConditionalKeyword(token.value) {
+			if err = scanner.handleConditional(token); err != nil {
+				return
+			}
+
+			continue
+		}
+
+		scanner.updateStatementStart(token)
+
+		if !scanner.conditionsActive() {
+			token.tokenType = CtkSkipped
+		}
+
+		return
+	}
+}
+
+// lexToken tokenizes the next token directly from the underlying reader, bypassing the peek
+// buffer and conditional evaluation
+func (scanner *ConfigScanner) lexToken() (token *ConfigToken, err error) {
 	char, eof, err := scanner.read()
 	startPos := scanner.pos
 
 	switch {
 	case err != nil:
 	case eof:
+		if len(scanner.includes) > 0 {
+			scanner.popInclude()
+			return scanner.lexToken()
+		}
+
+		if len(scanner.conditions) > 0 {
+			scanner.error(scanner.pos, "Unterminated if")
+		}
+
 		token = &ConfigToken{
 			tokenType: CtkEOF,
 			endPos:    scanner.pos,
@@ -206,7 +972,29 @@ func (scanner *ConfigScanner) Scan() (token *ConfigToken, err error) {
 			break
 		}
 
-		token, err = scanner.scanStringWord()
+		token, err = scanner.scanQuotedString()
+	case char == '`':
+		if err = scanner.unread(); err != nil {
+			break
+		}
+
+		token, err = scanner.scanRawString()
+	case char == '<':
+		var nextBytes []byte
+		nextBytes, err = scanner.reader.Peek(1)
+
+		if err != nil {
+			break
+		} else if len(nextBytes) == 1 && nextBytes[0] == '<' {
+			token, err = scanner.scanHeredoc()
+			break
+		}
+
+		if err = scanner.unread(); err != nil {
+			break
+		}
+
+		token, err = scanner.scanWord()
 	default:
 		if err = scanner.unread(); err != nil {
 			break
@@ -335,6 +1123,8 @@ func (scanner *ConfigScanner) scanWord() (token *ConfigToken, err error) {
 	var char rune
 	var eof bool
 
+	startPos := scanner.pos
+
 OuterLoop:
 	for {
 		char, eof, err = scanner.read()
@@ -359,18 +1149,21 @@ OuterLoop:
 
 	token = &ConfigToken{
 		tokenType: CtkWord,
-		value:     buffer.String(),
+		value:     scanner.expandVariables(buffer.String(), startPos),
 		endPos:    scanner.pos,
 	}
 
 	return
 }
 
-func (scanner *ConfigScanner) scanStringWord() (token *ConfigToken, err error) {
+// scanQuotedString scans a double-quoted string, processing backslash escapes in the result
+func (scanner *ConfigScanner) scanQuotedString() (token *ConfigToken, err error) {
 	var buffer bytes.Buffer
 	var char rune
 	var eof bool
 
+	startPos := scanner.pos
+
 	char, eof, err = scanner.read()
 	if err != nil || eof {
 		return
@@ -421,28 +1214,203 @@ OuterLoop:
 
 	if closingQuoteFound {
 		var word string
-		word, err = scanner.processStringWord(buffer.String())
-		if err != nil {
+		word, processErr := scanner.processStringWord(buffer.String())
+		if processErr != nil {
+			scanner.error(startPos, processErr.Error())
+
+			token = &ConfigToken{
+				tokenType: CtkInvalid,
+				value:     buffer.String(),
+				endPos:    scanner.pos,
+			}
+
+			return
+		}
+
+		token = &ConfigToken{
+			tokenType: CtkWord,
+			value:     scanner.expandVariables(word, startPos),
+			endPos:    scanner.pos,
+		}
+	} else {
+		scanner.error(startPos, "Unterminated string")
+
+		token = &ConfigToken{
+			tokenType: CtkInvalid,
+			value:     buffer.String(),
+			endPos:    scanner.pos,
+		}
+	}
+
+	return
+}
+
+// scanRawString scans a backtick-delimited string. No escape processing is performed, so the
+// result is exactly the bytes between the backticks, which makes it convenient for embedding
+// Windows paths and regexes in shell command arguments without doubling backslashes
+func (scanner *ConfigScanner) scanRawString() (token *ConfigToken, err error) {
+	var buffer bytes.Buffer
+	var char rune
+	var eof bool
+
+	startPos := scanner.pos
+
+	if char, eof, err = scanner.read(); err != nil || eof {
+		return
+	}
+
+	closingBacktickFound := false
+
+OuterLoop:
+	for {
+		char, eof, err = scanner.read()
+
+		switch {
+		case err != nil:
 			return
+		case eof:
+			break OuterLoop
+		case char == '`':
+			closingBacktickFound = true
+			break OuterLoop
+		default:
+			if _, err = buffer.WriteRune(char); err != nil {
+				return
+			}
 		}
+	}
 
+	if closingBacktickFound {
 		token = &ConfigToken{
 			tokenType: CtkWord,
-			value:     word,
+			value:     buffer.String(),
 			endPos:    scanner.pos,
 		}
 	} else {
+		scanner.error(startPos, "Unterminated raw string")
+
 		token = &ConfigToken{
 			tokenType: CtkInvalid,
 			value:     buffer.String(),
 			endPos:    scanner.pos,
-			err:       errors.New("Unterminated string"),
 		}
 	}
 
 	return
 }
 
+// scanHeredoc scans a shell-style heredoc of the form "<<TAG\n...body...\nTAG", capturing the
+// body as a single CtkWord with $NAME/${NAME} variable references expanded, just as they are in
+// other CtkWord values. TAG is an arbitrary word and must appear alone on its own line to
+// terminate the heredoc
+func (scanner *ConfigScanner) scanHeredoc() (token *ConfigToken, err error) {
+	startPos := scanner.pos
+	var char rune
+	var eof bool
+
+	// Consume the second '<' of the "<<" marker
+	if char, eof, err = scanner.read(); err != nil {
+		return
+	} else if eof || char != '<' {
+		scanner.error(scanner.pos, "Malformed heredoc marker")
+		token = &ConfigToken{tokenType: CtkInvalid, value: "<", endPos: scanner.pos}
+		return
+	}
+
+	var tagToken *ConfigToken
+	if tagToken, err = scanner.scanWord(); err != nil {
+		return
+	}
+
+	tag := tagToken.value
+	if tag == "" {
+		scanner.error(scanner.pos, "Heredoc is missing a terminator tag")
+		token = &ConfigToken{tokenType: CtkInvalid, value: "<<", endPos: scanner.pos}
+		return
+	}
+
+	// Discard the remainder of the line the heredoc marker appears on, including its newline
+	if _, err = scanner.scanToEndOfLine(CtkComment); err != nil {
+		return
+	}
+
+	if char, eof, err = scanner.read(); err != nil {
+		return
+	}
+
+	var body bytes.Buffer
+	first := true
+	terminated := false
+
+OuterLoop:
+	for {
+		var lineToken *ConfigToken
+		if lineToken, err = scanner.scanToEndOfLine(CtkWord); err != nil {
+			return
+		}
+
+		if char, eof, err = scanner.read(); err != nil {
+			return
+		}
+
+		if lineToken.value == tag {
+			terminated = true
+			break OuterLoop
+		}
+
+		if !first {
+			body.WriteRune('\n')
+		}
+		first = false
+		body.WriteString(lineToken.value)
+
+		if eof {
+			break OuterLoop
+		}
+	}
+
+	if !terminated {
+		scanner.error(scanner.pos, fmt.Sprintf("Unterminated heredoc: missing %q terminator", tag))
+
+		token = &ConfigToken{
+			tokenType: CtkInvalid,
+			value:     body.String(),
+			endPos:    scanner.pos,
+		}
+		return
+	}
+
+	token = &ConfigToken{
+		tokenType: CtkWord,
+		value:     scanner.expandVariables(body.String(), startPos),
+		endPos:    scanner.pos,
+	}
+
+	return
+}
+
+// hexEscape decodes exactly digits hex characters from chars starting at index start
+func hexEscape(chars []rune, start int, digits int) (rune, error) {
+	if start+digits > len(chars) {
+		return 0, fmt.Errorf("Expected %v hex digits", digits)
+	}
+
+	var value int64
+
+	for i := 0; i < digits; i++ {
+		char := chars[start+i]
+
+		digit, err := strconv.ParseInt(string(char), 16, 32)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid hex digit: %c", char)
+		}
+
+		value = value<<4 | digit
+	}
+
+	return rune(value), nil
+}
+
 func (scanner *ConfigScanner) processStringWord(str string) (string, error) {
 	var buffer bytes.Buffer
 	chars := []rune(str)
@@ -452,25 +1420,45 @@ func (scanner *ConfigScanner) processStringWord(str string) (string, error) {
 	}
 
 	chars = chars[1 : len(chars)-1]
-	escape := false
 
-	for _, char := range chars {
-		switch {
-		case escape:
-			switch char {
-			case 'n':
-				buffer.WriteRune('\n')
-			case 't':
-				buffer.WriteRune('\t')
-			default:
-				buffer.WriteRune(char)
-			}
+	for i := 0; i < len(chars); i++ {
+		char := chars[i]
 
-			escape = false
-		case char == '\\':
-			escape = true
-		default:
+		if char != '\\' || i == len(chars)-1 {
 			buffer.WriteRune(char)
+			continue
+		}
+
+		i++
+
+		switch chars[i] {
+		case 'n':
+			buffer.WriteRune('\n')
+		case 't':
+			buffer.WriteRune('\t')
+		case 'x':
+			value, err := hexEscape(chars, i+1, 2)
+			if err != nil {
+				return "", err
+			}
+			buffer.WriteRune(value)
+			i += 2
+		case 'u':
+			value, err := hexEscape(chars, i+1, 4)
+			if err != nil {
+				return "", err
+			}
+			buffer.WriteRune(value)
+			i += 4
+		case 'U':
+			value, err := hexEscape(chars, i+1, 8)
+			if err != nil {
+				return "", err
+			}
+			buffer.WriteRune(value)
+			i += 8
+		default:
+			buffer.WriteRune(chars[i])
 		}
 	}
 
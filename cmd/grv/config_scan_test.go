@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// collectErrors returns an ErrorHandler that appends every reported message to errs
+func collectErrors(errs *[]string) ErrorHandler {
+	return func(pos Position, msg string) {
+		*errs = append(*errs, msg)
+	}
+}
+
+// scanAll scans every token from input, returning their types in order (including the final
+// CtkEOF) and any messages reported through the ErrorHandler
+func scanAll(t *testing.T, input string) ([]ConfigTokenType, []string) {
+	t.Helper()
+
+	var errs []string
+	scanner := &ConfigScanner{}
+	scanner.Init(strings.NewReader(input), "", collectErrors(&errs))
+
+	var types []ConfigTokenType
+
+	for {
+		token, err := scanner.Scan()
+		if err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+
+		types = append(types, token.tokenType)
+
+		if token.tokenType == CtkEOF {
+			break
+		}
+	}
+
+	return types, errs
+}
+
+// TestScanRecoversFromInvalidEscape verifies that a malformed escape sequence in a quoted string
+// is reported through the ErrorHandler as a CtkInvalid token rather than aborting the scan, so
+// tokens following it are still produced
+func TestScanRecoversFromInvalidEscape(t *testing.T) {
+	types, errs := scanAll(t, `"\xZZ" word2`)
+
+	if len(errs) != 1 {
+		t.Fatalf("expected exactly one error, got %v: %v", len(errs), errs)
+	}
+
+	var sawInvalid, sawWord2 bool
+	for i, tokenType := range types {
+		if tokenType == CtkInvalid {
+			sawInvalid = true
+		}
+
+		if tokenType == CtkWord && i > 0 {
+			sawWord2 = true
+		}
+	}
+
+	if !sawInvalid {
+		t.Errorf("expected a CtkInvalid token for the malformed escape, got %v", types)
+	}
+
+	if !sawWord2 {
+		t.Errorf("expected scanning to continue past the invalid token and produce word2, got %v", types)
+	}
+
+	if types[len(types)-1] != CtkEOF {
+		t.Errorf("expected the final token to be CtkEOF, got %v", types[len(types)-1])
+	}
+}
+
+// TestScanRecoversFromUnterminatedString verifies the pre-existing recovery path (which the fix
+// for invalid escapes is modeled on) still reports via the ErrorHandler rather than erroring out
+func TestScanRecoversFromUnterminatedString(t *testing.T) {
+	types, errs := scanAll(t, `"unterminated`)
+
+	if len(errs) != 1 {
+		t.Fatalf("expected exactly one error, got %v: %v", len(errs), errs)
+	}
+
+	if types[len(types)-1] != CtkEOF {
+		t.Errorf("expected scanning to reach CtkEOF, got %v", types)
+	}
+}
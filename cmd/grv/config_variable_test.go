@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// scanSingleWord scans input (after applying setup) and returns the value of the first CtkWord
+// token produced, along with any messages reported through the ErrorHandler
+func scanSingleWord(t *testing.T, input string, setup func(*ConfigScanner)) (string, []string) {
+	t.Helper()
+
+	var errs []string
+	scanner := &ConfigScanner{}
+	scanner.Init(strings.NewReader(input), "", collectErrors(&errs))
+
+	if setup != nil {
+		setup(scanner)
+	}
+
+	for {
+		token, err := scanner.Scan()
+		if err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+
+		if token.tokenType == CtkEOF {
+			t.Fatalf("reached EOF without finding a word token")
+		}
+
+		if token.tokenType == CtkWord {
+			return token.value, errs
+		}
+	}
+}
+
+// TestExpandVariablesPrecedence verifies a user variable set via SetVariable takes precedence
+// over a built-in of the same name, which in turn takes precedence over the environment
+func TestExpandVariablesPrecedence(t *testing.T) {
+	t.Setenv("GRV_TEST_VAR", "env-value")
+
+	value, errs := scanSingleWord(t, "$GRV_TEST_VAR", func(scanner *ConfigScanner) {
+		scanner.SetBuiltinVariables(map[string]string{"GRV_TEST_VAR": "builtin-value"})
+		scanner.SetVariable("GRV_TEST_VAR", "user-value")
+	})
+
+	if len(errs) != 0 {
+		t.Fatalf("expected no errors, got %v", errs)
+	}
+
+	if value != "user-value" {
+		t.Errorf("expected user variable to take precedence, got %q", value)
+	}
+}
+
+// TestExpandVariablesBuiltinFallback verifies a built-in is used when no user variable of the
+// same name has been set
+func TestExpandVariablesBuiltinFallback(t *testing.T) {
+	value, _ := scanSingleWord(t, "${GRV_TEST_VAR}", func(scanner *ConfigScanner) {
+		scanner.SetBuiltinVariables(map[string]string{"GRV_TEST_VAR": "builtin-value"})
+	})
+
+	if value != "builtin-value" {
+		t.Errorf("expected the built-in value, got %q", value)
+	}
+}
+
+// TestExpandVariablesUndefinedNonStrict verifies an unresolved variable expands to the empty
+// string and reports no error when strict expansion is not enabled (the default)
+func TestExpandVariablesUndefinedNonStrict(t *testing.T) {
+	value, errs := scanSingleWord(t, "prefix-$UNDEFINED_GRV_TEST_VAR-suffix", nil)
+
+	if len(errs) != 0 {
+		t.Fatalf("expected no errors, got %v", errs)
+	}
+
+	if value != "prefix--suffix" {
+		t.Errorf("expected the undefined reference to expand to empty, got %q", value)
+	}
+}
+
+// TestExpandVariablesUndefinedStrict verifies an unresolved variable is reported as an error
+// through the ErrorHandler once strict expansion is enabled
+func TestExpandVariablesUndefinedStrict(t *testing.T) {
+	_, errs := scanSingleWord(t, "$UNDEFINED_GRV_TEST_VAR", func(scanner *ConfigScanner) {
+		scanner.SetStrictExpansion(true)
+	})
+
+	if len(errs) != 1 {
+		t.Fatalf("expected exactly one error, got %v: %v", len(errs), errs)
+	}
+}
+
+// TestExpandVariablesEscapedDollar verifies "$$" expands to a literal "$" rather than being
+// treated as a variable reference
+func TestExpandVariablesEscapedDollar(t *testing.T) {
+	value, errs := scanSingleWord(t, "$$5", nil)
+
+	if len(errs) != 0 {
+		t.Fatalf("expected no errors, got %v", errs)
+	}
+
+	if value != "$5" {
+		t.Errorf("expected \"$$5\" to expand to \"$5\", got %q", value)
+	}
+}